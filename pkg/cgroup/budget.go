@@ -0,0 +1,90 @@
+package cgroup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBudgetNs is the ceiling applied when deriving a budget from cgroup
+// CPU limits, and the starting value (before scaling by importance) when a
+// pod's cgroup is unthrottled (cpu.max == "max" or no quota set).
+const DefaultBudgetNs = uint64(100 * time.Millisecond)
+
+// DeriveBudgetMs computes a budget in milliseconds from the CPU quota
+// programmed on the cgroup at cgroupPath, scaled by importance. It is shared
+// by both the K8s-watch fallback (which has a pod's QOS class to derive
+// importance from) and the NRI plugin (which doesn't, and so passes a fixed
+// importance), so the cgroup-reading logic only needs to be
+// gotten right in one place.
+func DeriveBudgetMs(cgroupPath string, importance uint64) (uint64, error) {
+	quotaNs, err := ReadCPUQuotaNs(cgroupPath)
+	if err != nil {
+		return 0, err
+	}
+
+	budgetNs := quotaNs
+	if budgetNs == 0 || budgetNs > DefaultBudgetNs {
+		budgetNs = DefaultBudgetNs
+	}
+	budgetNs = uint64(float64(budgetNs) * (float64(importance) / 100.0))
+
+	budgetMs := budgetNs / uint64(time.Millisecond)
+	if budgetMs == 0 {
+		budgetMs = 1
+	}
+	return budgetMs, nil
+}
+
+// ReadCPUQuotaNs reads the CPU quota programmed on the cgroup at cgroupPath
+// and returns it in nanoseconds-per-second-of-wallclock terms (i.e. a
+// cgroup limited to half a core returns 500ms worth of ns). It tries the
+// cgroupv2 layout (cpu.max) first, then falls back to cgroupv1
+// (cpu.cfs_quota_us / cpu.cfs_period_us). A return of (0, nil) means the
+// cgroup is unthrottled.
+func ReadCPUQuotaNs(cgroupPath string) (uint64, error) {
+	if data, err := os.ReadFile(filepath.Join(cgroupPath, "cpu.max")); err == nil {
+		parts := strings.Fields(strings.TrimSpace(string(data)))
+		if len(parts) != 2 {
+			return 0, fmt.Errorf("unexpected cpu.max format: %q", data)
+		}
+		if parts[0] == "max" {
+			return 0, nil
+		}
+		quota, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cpu.max quota: %w", err)
+		}
+		period, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil || period == 0 {
+			return 0, fmt.Errorf("invalid cpu.max period: %w", err)
+		}
+		return uint64(float64(quota) / float64(period) * float64(time.Second)), nil
+	}
+
+	quotaData, err := os.ReadFile(filepath.Join(cgroupPath, "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, fmt.Errorf("no cpu.max or cpu.cfs_quota_us under %s: %w", cgroupPath, err)
+	}
+	quota, err := strconv.ParseInt(strings.TrimSpace(string(quotaData)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cpu.cfs_quota_us: %w", err)
+	}
+	if quota < 0 {
+		return 0, nil
+	}
+
+	periodData, err := os.ReadFile(filepath.Join(cgroupPath, "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read cpu.cfs_period_us: %w", err)
+	}
+	period, err := strconv.ParseUint(strings.TrimSpace(string(periodData)), 10, 64)
+	if err != nil || period == 0 {
+		return 0, fmt.Errorf("invalid cpu.cfs_period_us: %w", err)
+	}
+
+	return uint64(float64(quota) / float64(period) * float64(time.Second)), nil
+}
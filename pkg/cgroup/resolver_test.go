@@ -0,0 +1,142 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func mkdirAll(t *testing.T, path string) {
+	t.Helper()
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		t.Fatalf("failed to create fake cgroup dir %s: %v", path, err)
+	}
+}
+
+func testPod(uid types.UID, qos corev1.PodQOSClass) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pod", UID: uid},
+		Status:     corev1.PodStatus{QOSClass: qos},
+	}
+}
+
+func TestSystemdResolver(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBurstable)
+	mkdirAll(t, filepath.Join(root, "kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-podabcd_1234.slice"))
+
+	got, err := SystemdResolver{}.Resolve(root, pod)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := filepath.Join(root, "kubepods.slice", "kubepods-burstable.slice", "kubepods-burstable-podabcd_1234.slice")
+	if got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdResolverNoMatch(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBurstable)
+	if _, err := (SystemdResolver{}).Resolve(root, pod); err == nil {
+		t.Error("Resolve() expected error for nonexistent cgroup, got nil")
+	}
+}
+
+func TestGuaranteedSystemdResolver(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSGuaranteed)
+	mkdirAll(t, filepath.Join(root, "kubepods.slice", "kubepods-podabcd_1234.slice"))
+
+	got, err := GuaranteedSystemdResolver{}.Resolve(root, pod)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := filepath.Join(root, "kubepods.slice", "kubepods-podabcd_1234.slice")
+	if got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestGuaranteedSystemdResolverRejectsOtherQOS(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBurstable)
+	mkdirAll(t, filepath.Join(root, "kubepods.slice", "kubepods-podabcd_1234.slice"))
+
+	if _, err := (GuaranteedSystemdResolver{}).Resolve(root, pod); err == nil {
+		t.Error("Resolve() expected error for non-Guaranteed pod, got nil")
+	}
+}
+
+func TestCgroupfsResolver(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBestEffort)
+	mkdirAll(t, filepath.Join(root, "kubepods", "besteffort", "podabcd-1234"))
+
+	got, err := CgroupfsResolver{}.Resolve(root, pod)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := filepath.Join(root, "kubepods", "besteffort", "podabcd-1234")
+	if got != want {
+		t.Errorf("Resolve() = %q, want %q", got, want)
+	}
+}
+
+func TestChainResolverFallsThroughAndCaches(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBestEffort)
+	mkdirAll(t, filepath.Join(root, "kubepods", "besteffort", "podabcd-1234"))
+
+	chain := NewChainResolver(SystemdResolver{}, GuaranteedSystemdResolver{}, CgroupfsResolver{})
+
+	path, err := chain.Resolve(root, pod)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	want := filepath.Join(root, "kubepods", "besteffort", "podabcd-1234")
+	if path != want {
+		t.Errorf("Resolve() = %q, want %q", path, want)
+	}
+
+	if chain.winner == nil || chain.winner.Name() != "cgroupfs" {
+		t.Errorf("expected chain to cache the cgroupfs resolver as winner, got %v", chain.winner)
+	}
+
+	// A second pod under the same layout should resolve straight through
+	// the cached winner without needing the other resolvers to exist.
+	pod2 := testPod("ef01-5678", corev1.PodQOSBestEffort)
+	mkdirAll(t, filepath.Join(root, "kubepods", "besteffort", "podef01-5678"))
+	if _, err := chain.Resolve(root, pod2); err != nil {
+		t.Fatalf("Resolve() with cached winner error = %v", err)
+	}
+}
+
+func TestChainResolverNoMatch(t *testing.T) {
+	root := t.TempDir()
+	pod := testPod("abcd-1234", corev1.PodQOSBestEffort)
+
+	chain := NewChainResolver(SystemdResolver{}, GuaranteedSystemdResolver{}, CgroupfsResolver{})
+	if _, err := chain.Resolve(root, pod); err == nil {
+		t.Error("Resolve() expected error when no layout matches, got nil")
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	v2Root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(v2Root, "cgroup.controllers"), []byte("cpu memory\n"), 0o644); err != nil {
+		t.Fatalf("failed to write fake cgroup.controllers: %v", err)
+	}
+	if got := DetectVersion(v2Root); got != VersionV2 {
+		t.Errorf("DetectVersion(v2Root) = %v, want VersionV2", got)
+	}
+
+	v1Root := t.TempDir()
+	if got := DetectVersion(v1Root); got != VersionV1 {
+		t.Errorf("DetectVersion(v1Root) = %v, want VersionV1", got)
+	}
+}
@@ -0,0 +1,284 @@
+// Package nriplugin implements an NRI (Node Resource Interface) plugin that
+// observes container lifecycle events directly from the container runtime.
+//
+// Unlike resolving cgroup paths from Pod UID + QOS class after the fact, NRI
+// hands us the runtime's own view of the sandbox/container cgroup path at the
+// moment it is created, so there is no race between the Pod object landing in
+// the API server and the cgroup actually existing on disk, and no guessing
+// between cgroupfs/systemd driver layouts.
+package nriplugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/containerd/nri/pkg/api"
+	"github.com/containerd/nri/pkg/stub"
+
+	"github.com/srijanshukla18/scx-slo/pkg/cgroup"
+)
+
+// SloUpdater is the subset of agent behavior the plugin needs in order to
+// program the pinned BPF map. main wires this to the real map-update/delete
+// logic so this package stays independent of the ebpf map implementation.
+type SloUpdater interface {
+	UpdateSLO(cgroupPath string, budgetMs, importance uint64) error
+	DeleteSLO(cgroupPath string) error
+}
+
+// Plugin is an NRI plugin that tracks PodSandbox and Container lifecycle
+// events and keeps the pinned slo_map in sync with pod SLO annotations.
+type Plugin struct {
+	stub.Stub
+
+	updater SloUpdater
+	autoSLO bool
+
+	mu sync.Mutex
+	// sandboxCgroup remembers the cgroup path we programmed for a sandbox so
+	// RemovePodSandbox can clean it up without re-deriving it.
+	sandboxCgroup map[string]string
+	// containerCgroup remembers the cgroup path we programmed for a
+	// container so RemoveContainer can clean it up the same way; a
+	// container's cgroup is a distinct sub-cgroup nested under its
+	// sandbox's when the runtime scopes budgets per-container, so it needs
+	// its own lifecycle tracking rather than piggybacking on sandboxCgroup.
+	containerCgroup map[string]string
+}
+
+const (
+	AnnotationBudget     = "scx-slo/budget-ms"
+	AnnotationImportance = "scx-slo/importance"
+
+	defaultBudgetMs   = 100
+	defaultImportance = 50
+
+	// autoImportance is the importance assigned to auto-derived SLOs on
+	// this codepath. Unlike the K8s-watch fallback, NRI's PodSandbox/
+	// Container types don't carry the pod's QOS class, so there's nothing
+	// to key deriveImportanceFromQOS off of here.
+	autoImportance = defaultImportance
+
+	socketPath = "/var/run/nri/nri.sock"
+)
+
+// New creates a Plugin and registers it with the local NRI socket. It does
+// not block; call Run to start serving events. When autoSLO is set, pods
+// and containers that carry neither scx-slo annotation get a budget derived
+// from their cgroup's CPU limits and the fixed importance autoImportance
+// instead of being skipped. Unlike the K8s-watch fallback's --auto-slo
+// path, importance is not derived from the pod's QOS class here.
+func New(updater SloUpdater, autoSLO bool) (*Plugin, error) {
+	p := &Plugin{
+		updater:         updater,
+		autoSLO:         autoSLO,
+		sandboxCgroup:   make(map[string]string),
+		containerCgroup: make(map[string]string),
+	}
+
+	s, err := stub.New(p,
+		stub.WithSocketPath(socketPath),
+		stub.WithPluginName("scx-slo"),
+		stub.WithPluginIdx("10"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NRI stub: %w", err)
+	}
+	p.Stub = s
+
+	return p, nil
+}
+
+// Run starts serving NRI events. It blocks until the runtime closes the
+// connection (e.g. NRI support is disabled or the runtime restarts), at
+// which point it returns so the caller can fall back to the Watch-based
+// codepath.
+func (p *Plugin) Run(ctx context.Context) error {
+	log.Printf("nriplugin: connecting to runtime at %s", socketPath)
+	if err := p.Stub.Run(ctx); err != nil {
+		return fmt.Errorf("NRI stub exited: %w", err)
+	}
+	return nil
+}
+
+// RunPodSandbox is called when a pod sandbox has been created and its cgroup
+// is in place.
+func (p *Plugin) RunPodSandbox(_ context.Context, pod *api.PodSandbox) error {
+	p.programSandbox(pod)
+	return nil
+}
+
+// Synchronize is called once, right after the plugin connects, with every
+// pod sandbox and container the runtime already considers running. Without
+// it, an agent restart would stop enforcing SLOs for every already-running
+// container until the runtime happened to recreate it, since RunPodSandbox/
+// StartContainer only fire for lifecycle events that occur after we connect.
+// This is the NRI-path equivalent of a fresh K8s List/Watch redelivering Add
+// events for already-running pods. It only programs entries: unlike the
+// watch fallback's reconcileLoop, it does not prune slo_map entries that
+// belong to no running sandbox or container.
+func (p *Plugin) Synchronize(_ context.Context, pods []*api.PodSandbox, containers []*api.Container) ([]*api.ContainerUpdate, error) {
+	podByID := make(map[string]*api.PodSandbox, len(pods))
+	for _, pod := range pods {
+		podByID[pod.GetId()] = pod
+		p.programSandbox(pod)
+	}
+
+	for _, ctr := range containers {
+		pod, ok := podByID[ctr.GetPodSandboxId()]
+		if !ok {
+			log.Printf("nriplugin: sync: container %s references unknown sandbox %s, skipping", ctr.GetId(), ctr.GetPodSandboxId())
+			continue
+		}
+		p.programContainer(pod, ctr)
+	}
+
+	return nil, nil
+}
+
+// programSandbox records and programs the SLO for a sandbox's cgroup. It is
+// shared by RunPodSandbox and Synchronize.
+func (p *Plugin) programSandbox(pod *api.PodSandbox) {
+	cgroupPath := pod.GetLinux().GetCgroupsPath()
+	if cgroupPath == "" {
+		log.Printf("nriplugin: sandbox %s/%s has no cgroup path, skipping", pod.GetNamespace(), pod.GetName())
+		return
+	}
+
+	budgetMs, importance, ok := p.sloFor(pod.GetAnnotations(), cgroupPath)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	p.sandboxCgroup[pod.GetId()] = cgroupPath
+	p.mu.Unlock()
+
+	if err := p.updater.UpdateSLO(cgroupPath, budgetMs, importance); err != nil {
+		log.Printf("nriplugin: failed to update SLO for sandbox %s: %v", pod.GetId(), err)
+	}
+}
+
+// CreateContainer is called before a container is started; it has nothing
+// to do, since the container's cgroup isn't necessarily set up yet at this
+// point. StartContainer is where the SLO actually gets programmed and the
+// cgroup path recorded for later cleanup.
+func (p *Plugin) CreateContainer(_ context.Context, pod *api.PodSandbox, ctr *api.Container) (*api.ContainerAdjustment, *api.ContainerUpdate, error) {
+	return nil, nil, nil
+}
+
+// StartContainer applies the SLO to the container's own cgroup, in case it
+// differs from the sandbox cgroup (e.g. per-container cgroup scoping), and
+// remembers that cgroup so RemoveContainer can clean it up.
+func (p *Plugin) StartContainer(_ context.Context, pod *api.PodSandbox, ctr *api.Container) error {
+	p.programContainer(pod, ctr)
+	return nil
+}
+
+// programContainer records and programs the SLO for a container's own
+// cgroup. It is shared by StartContainer and Synchronize.
+func (p *Plugin) programContainer(pod *api.PodSandbox, ctr *api.Container) {
+	cgroupPath := ctr.GetLinux().GetCgroupsPath()
+	if cgroupPath == "" {
+		return
+	}
+
+	budgetMs, importance, ok := p.sloFor(pod.GetAnnotations(), cgroupPath)
+	if !ok {
+		return
+	}
+
+	p.mu.Lock()
+	p.containerCgroup[ctr.GetId()] = cgroupPath
+	p.mu.Unlock()
+
+	if err := p.updater.UpdateSLO(cgroupPath, budgetMs, importance); err != nil {
+		log.Printf("nriplugin: failed to update SLO for container %s: %v", ctr.GetId(), err)
+	}
+}
+
+// RemovePodSandbox cleans up the slo_map entry for a sandbox's cgroup. This
+// is the piece the old Watch-based agent never did, which let stale cgID
+// entries accumulate forever.
+func (p *Plugin) RemovePodSandbox(_ context.Context, pod *api.PodSandbox) error {
+	p.mu.Lock()
+	cgroupPath, ok := p.sandboxCgroup[pod.GetId()]
+	delete(p.sandboxCgroup, pod.GetId())
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := p.updater.DeleteSLO(cgroupPath); err != nil {
+		log.Printf("nriplugin: failed to delete SLO for sandbox %s: %v", pod.GetId(), err)
+	}
+	return nil
+}
+
+// RemoveContainer cleans up the slo_map entry for a container's own cgroup,
+// if StartContainer ever programmed one. This is the container-granularity
+// counterpart to RemovePodSandbox: without it, every per-container entry
+// written by StartContainer would leak forever once the container is
+// removed, reintroducing the stale-cgID accumulation bug at a finer grain.
+func (p *Plugin) RemoveContainer(_ context.Context, pod *api.PodSandbox, ctr *api.Container) error {
+	p.mu.Lock()
+	cgroupPath, ok := p.containerCgroup[ctr.GetId()]
+	delete(p.containerCgroup, ctr.GetId())
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := p.updater.DeleteSLO(cgroupPath); err != nil {
+		log.Printf("nriplugin: failed to delete SLO for container %s: %v", ctr.GetId(), err)
+	}
+	return nil
+}
+
+// sloFor returns the budget/importance to program for cgroupPath: the
+// scx-slo annotations if present, otherwise an auto-derived SLO from the
+// cgroup's CPU limits when the plugin was started with --auto-slo. This
+// mirrors podWatcher.applySLO/applyAutoSLO in the K8s-watch fallback, except
+// that auto-derived SLOs always get autoImportance here rather than an
+// importance derived from the pod's QOS class.
+func (p *Plugin) sloFor(annotations map[string]string, cgroupPath string) (budgetMs, importance uint64, ok bool) {
+	if budgetMs, importance, ok := sloFromAnnotations(annotations); ok {
+		return budgetMs, importance, true
+	}
+	if !p.autoSLO {
+		return 0, 0, false
+	}
+
+	budgetMs, err := cgroup.DeriveBudgetMs(cgroupPath, autoImportance)
+	if err != nil {
+		log.Printf("nriplugin: auto-slo: could not derive budget for cgroup %s: %v", cgroupPath, err)
+		return 0, 0, false
+	}
+	return budgetMs, autoImportance, true
+}
+
+func sloFromAnnotations(annotations map[string]string) (budgetMs, importance uint64, ok bool) {
+	budgetStr, hasBudget := annotations[AnnotationBudget]
+	importStr, hasImportance := annotations[AnnotationImportance]
+	if !hasBudget && !hasImportance {
+		return 0, 0, false
+	}
+
+	budgetMs = parseUintOrZero(budgetStr)
+	importance = parseUintOrZero(importStr)
+	if budgetMs == 0 {
+		budgetMs = defaultBudgetMs
+	}
+	if importance == 0 {
+		importance = defaultImportance
+	}
+	return budgetMs, importance, true
+}
+
+func parseUintOrZero(s string) uint64 {
+	var v uint64
+	_, _ = fmt.Sscanf(s, "%d", &v)
+	return v
+}
@@ -0,0 +1,182 @@
+// Package slosrv exposes a small HTTP server for observing what the agent
+// has actually programmed into the pinned slo_map, so operators don't need
+// `bpftool map dump` and root BPF tooling just to see what's going on.
+package slosrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Entry mirrors one row of the pinned slo_map.
+type Entry struct {
+	CgroupID   uint64
+	BudgetMs   uint64
+	Importance uint32
+}
+
+// MapReader gives the server read access to the pinned slo_map without
+// depending on the ebpf map type directly.
+type MapReader interface {
+	Entries() ([]Entry, error)
+}
+
+// PodResolver reverse-resolves a cgroup ID back to the pod it belongs to,
+// using the in-memory pod→cgID cache the informer maintains. Pods managed
+// purely through the NRI plugin codepath won't be resolvable here, since
+// that cache is only populated by the K8s watch fallback.
+type PodResolver interface {
+	PodForCgroupID(cgID uint64) (name string, ok bool)
+}
+
+// budgetBucketsMs are the histogram bucket upper bounds, in milliseconds,
+// for budgets actually programmed into the map.
+var budgetBucketsMs = []uint64{1, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// Server serves /metrics (Prometheus text format) and /slo/dump (JSON) on
+// a loopback-only address by default.
+type Server struct {
+	addr        string
+	mapReader   MapReader
+	podResolver PodResolver
+
+	updatesOK, updatesErr, deletes, resolveFailures uint64
+
+	mu            sync.Mutex
+	budgetBuckets []uint64 // parallel to budgetBucketsMs, cumulative counts
+	budgetCount   uint64   // total observations, regardless of bucket membership
+	budgetSumMs   uint64   // sum of all observed budgets, for computing an average
+}
+
+// New creates a Server. It does not start listening; call ListenAndServe.
+func New(addr string, mapReader MapReader, podResolver PodResolver) *Server {
+	return &Server{
+		addr:          addr,
+		mapReader:     mapReader,
+		podResolver:   podResolver,
+		budgetBuckets: make([]uint64, len(budgetBucketsMs)),
+	}
+}
+
+// RecordUpdate records the result of a slo_map write, and if it succeeded,
+// the budget value that was programmed.
+func (s *Server) RecordUpdate(ok bool, budgetMs uint64) {
+	if ok {
+		atomic.AddUint64(&s.updatesOK, 1)
+		s.recordBudget(budgetMs)
+		return
+	}
+	atomic.AddUint64(&s.updatesErr, 1)
+}
+
+// RecordDelete records a successful slo_map deletion.
+func (s *Server) RecordDelete() {
+	atomic.AddUint64(&s.deletes, 1)
+}
+
+// RecordResolveFailure records a failure to resolve a cgroup path or ID.
+func (s *Server) RecordResolveFailure() {
+	atomic.AddUint64(&s.resolveFailures, 1)
+}
+
+func (s *Server) recordBudget(budgetMs uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.budgetCount++
+	s.budgetSumMs += budgetMs
+	for i, bound := range budgetBucketsMs {
+		if budgetMs <= bound {
+			s.budgetBuckets[i]++
+		}
+	}
+}
+
+// ListenAndServe starts the HTTP server and blocks until it exits.
+func (s *Server) ListenAndServe() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/slo/dump", s.handleDump)
+	return http.ListenAndServe(s.addr, mux)
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	entries, err := s.mapReader.Entries()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read slo_map: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP scx_slo_map_entries Number of entries currently pinned in slo_map.\n")
+	fmt.Fprintf(w, "# TYPE scx_slo_map_entries gauge\n")
+	fmt.Fprintf(w, "scx_slo_map_entries %d\n", len(entries))
+
+	fmt.Fprintf(w, "# HELP scx_slo_updates_total Total slo_map writes, by result.\n")
+	fmt.Fprintf(w, "# TYPE scx_slo_updates_total counter\n")
+	fmt.Fprintf(w, "scx_slo_updates_total{result=\"ok\"} %d\n", atomic.LoadUint64(&s.updatesOK))
+	fmt.Fprintf(w, "scx_slo_updates_total{result=\"err\"} %d\n", atomic.LoadUint64(&s.updatesErr))
+
+	fmt.Fprintf(w, "# HELP scx_slo_deletes_total Total slo_map entries deleted.\n")
+	fmt.Fprintf(w, "# TYPE scx_slo_deletes_total counter\n")
+	fmt.Fprintf(w, "scx_slo_deletes_total %d\n", atomic.LoadUint64(&s.deletes))
+
+	fmt.Fprintf(w, "# HELP scx_slo_cgroup_resolve_failures_total Total failures resolving a cgroup path or ID.\n")
+	fmt.Fprintf(w, "# TYPE scx_slo_cgroup_resolve_failures_total counter\n")
+	fmt.Fprintf(w, "scx_slo_cgroup_resolve_failures_total %d\n", atomic.LoadUint64(&s.resolveFailures))
+
+	fmt.Fprintf(w, "# HELP scx_slo_budget_ms Budget values (ms) programmed into slo_map.\n")
+	fmt.Fprintf(w, "# TYPE scx_slo_budget_ms histogram\n")
+	s.mu.Lock()
+	buckets := make([]uint64, len(s.budgetBuckets))
+	copy(buckets, s.budgetBuckets)
+	count, sumMs := s.budgetCount, s.budgetSumMs
+	s.mu.Unlock()
+	for i, bound := range budgetBucketsMs {
+		fmt.Fprintf(w, "scx_slo_budget_ms_bucket{le=\"%d\"} %d\n", bound, buckets[i])
+	}
+	fmt.Fprintf(w, "scx_slo_budget_ms_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "scx_slo_budget_ms_sum %d\n", sumMs)
+	fmt.Fprintf(w, "scx_slo_budget_ms_count %d\n", count)
+}
+
+// dumpEntry is the JSON shape returned by /slo/dump.
+type dumpEntry struct {
+	Pod        string `json:"pod,omitempty"`
+	CgroupID   uint64 `json:"cgroup_id"`
+	BudgetMs   uint64 `json:"budget_ms"`
+	Importance uint32 `json:"importance"`
+}
+
+func (s *Server) handleDump(w http.ResponseWriter, _ *http.Request) {
+	entries, err := s.mapReader.Entries()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read slo_map: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	dump := make([]dumpEntry, 0, len(entries))
+	for _, e := range entries {
+		d := dumpEntry{
+			CgroupID:   e.CgroupID,
+			BudgetMs:   e.BudgetMs,
+			Importance: e.Importance,
+		}
+		if s.podResolver != nil {
+			if name, ok := s.podResolver.PodForCgroupID(e.CgroupID); ok {
+				d.Pod = name
+			}
+		}
+		dump = append(dump, d)
+	}
+	sort.Slice(dump, func(i, j int) bool { return dump[i].CgroupID < dump[j].CgroupID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(dump); err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode dump: %v", err), http.StatusInternalServerError)
+	}
+}
@@ -2,19 +2,47 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/cilium/ebpf"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/srijanshukla18/scx-slo/pkg/cgroup"
+	"github.com/srijanshukla18/scx-slo/pkg/nriplugin"
+	"github.com/srijanshukla18/scx-slo/pkg/slosrv"
 )
 
+// cgroupRoot is where the cgroup hierarchy is mounted; real clusters only
+// ever mount it here, but resolvers take it as a parameter so tests can
+// point them at a fake tree instead.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// reconcileInterval is how often the fallback watcher re-lists pods and
+// prunes slo_map entries that no longer correspond to a pod on this node.
+// This heals the map after agent restarts or events missed during a
+// disconnect.
+const reconcileInterval = 30 * time.Second
+
+var autoSLO = flag.Bool("auto-slo", false,
+	"derive SLO budget/importance from cgroup CPU limits and QOS class when scx-slo annotations are absent")
+
+var metricsAddr = flag.String("metrics-addr", "127.0.0.1:9090",
+	"address to serve /metrics and /slo/dump on")
+
 const (
 	AnnotationBudget     = "scx-slo/budget-ms"
 	AnnotationImportance = "scx-slo/importance"
@@ -28,11 +56,186 @@ type sloCfg struct {
 	Flags      uint32
 }
 
+// agent owns the pinned BPF map and is shared between the NRI plugin and the
+// Watch-based fallback so both codepaths program SLOs the same way.
+type agent struct {
+	m       *ebpf.Map
+	version cgroup.Version
+	metrics *slosrv.Server // optional; nil until the metrics server is wired up
+}
+
+// UpdateSLO implements nriplugin.SloUpdater: it resolves cgroupPath (as
+// handed to us directly by the runtime) to a kernel cgroup ID and writes it
+// into the pinned map.
+func (a *agent) UpdateSLO(cgroupPath string, budgetMs, importance uint64) error {
+	cgID, err := cgroup.IDFromPath(cgroupPath, a.version)
+	if err != nil {
+		a.recordResolveFailure()
+		return fmt.Errorf("failed to resolve cgroup ID for %s: %w", cgroupPath, err)
+	}
+
+	cfg := sloCfg{
+		BudgetNs:   budgetMs * 1000000,
+		Importance: uint32(importance),
+		Flags:      0,
+	}
+	if err := a.m.Update(cgID, cfg, ebpf.UpdateAny); err != nil {
+		a.recordUpdate(false, 0)
+		return fmt.Errorf("failed to update BPF map for cgID %d: %w", cgID, err)
+	}
+	a.recordUpdate(true, budgetMs)
+	log.Printf("Updated SLO for cgroup %s (cgID %d): budget=%dms, importance=%d", cgroupPath, cgID, budgetMs, importance)
+	return nil
+}
+
+// DeleteSLO removes the slo_map entry for cgroupPath, if any.
+func (a *agent) DeleteSLO(cgroupPath string) error {
+	cgID, err := cgroup.IDFromPath(cgroupPath, a.version)
+	if err != nil {
+		a.recordResolveFailure()
+		return fmt.Errorf("failed to resolve cgroup ID for %s: %w", cgroupPath, err)
+	}
+	return a.deleteCgID(cgID)
+}
+
+// deleteCgID removes a slo_map entry by its already-resolved cgroup ID,
+// used when the cgroup directory (and therefore the path) is already gone.
+func (a *agent) deleteCgID(cgID uint64) error {
+	if err := a.m.Delete(cgID); err != nil {
+		return fmt.Errorf("failed to delete BPF map entry for cgID %d: %w", cgID, err)
+	}
+	a.recordDelete()
+	log.Printf("Deleted stale SLO entry for cgID %d", cgID)
+	return nil
+}
+
+// liveCgIDs returns the set of cgroup IDs currently pinned in slo_map.
+func (a *agent) liveCgIDs() (map[uint64]struct{}, error) {
+	ids := make(map[uint64]struct{})
+	var key uint64
+	var value sloCfg
+	it := a.m.Iterate()
+	for it.Next(&key, &value) {
+		ids[key] = struct{}{}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate slo_map: %w", err)
+	}
+	return ids, nil
+}
+
+// Entries implements slosrv.MapReader by walking the pinned slo_map.
+func (a *agent) Entries() ([]slosrv.Entry, error) {
+	var entries []slosrv.Entry
+	var key uint64
+	var value sloCfg
+	it := a.m.Iterate()
+	for it.Next(&key, &value) {
+		entries = append(entries, slosrv.Entry{
+			CgroupID:   key,
+			BudgetMs:   value.BudgetNs / 1000000,
+			Importance: value.Importance,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate slo_map: %w", err)
+	}
+	return entries, nil
+}
+
+func (a *agent) recordUpdate(ok bool, budgetMs uint64) {
+	if a.metrics != nil {
+		a.metrics.RecordUpdate(ok, budgetMs)
+	}
+}
+
+func (a *agent) recordDelete() {
+	if a.metrics != nil {
+		a.metrics.RecordDelete()
+	}
+}
+
+func (a *agent) recordResolveFailure() {
+	if a.metrics != nil {
+		a.metrics.RecordResolveFailure()
+	}
+}
+
+// podNameCache is the in-memory pod→cgID cache maintained by the informer
+// fallback. It also implements slosrv.PodResolver so /slo/dump can reverse-
+// resolve a cgID back to a pod name; NRI-managed entries won't resolve
+// here since only the watch fallback populates this cache.
+type podNameCache struct {
+	mu         sync.Mutex
+	cgIDByUID  map[types.UID]uint64
+	uidByCgID  map[uint64]types.UID
+	nameByCgID map[uint64]string
+}
+
+func newPodNameCache() *podNameCache {
+	return &podNameCache{
+		cgIDByUID:  make(map[types.UID]uint64),
+		uidByCgID:  make(map[uint64]types.UID),
+		nameByCgID: make(map[uint64]string),
+	}
+}
+
+func (c *podNameCache) set(pod *corev1.Pod, cgID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cgIDByUID[pod.UID] = cgID
+	c.uidByCgID[cgID] = pod.UID
+	c.nameByCgID[cgID] = pod.Namespace + "/" + pod.Name
+}
+
+func (c *podNameCache) cgIDForUID(uid types.UID) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cgID, ok := c.cgIDByUID[uid]
+	return cgID, ok
+}
+
+func (c *podNameCache) delete(uid types.UID) (uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cgID, ok := c.cgIDByUID[uid]
+	if !ok {
+		return 0, false
+	}
+	delete(c.cgIDByUID, uid)
+	delete(c.uidByCgID, cgID)
+	delete(c.nameByCgID, cgID)
+	return cgID, true
+}
+
+// deleteByCgID evicts a cache entry by cgID instead of UID, for the
+// reconcile path: it learns about stale entries (pods whose Delete event
+// was missed) from the BPF map, not from a UID, so it has no UID to call
+// delete with directly.
+func (c *podNameCache) deleteByCgID(cgID uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if uid, ok := c.uidByCgID[cgID]; ok {
+		delete(c.cgIDByUID, uid)
+	}
+	delete(c.uidByCgID, cgID)
+	delete(c.nameByCgID, cgID)
+}
+
+// PodForCgroupID implements slosrv.PodResolver.
+func (c *podNameCache) PodForCgroupID(cgID uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.nameByCgID[cgID]
+	return name, ok
+}
+
 func main() {
 	nodeName := os.Getenv("NODE_NAME")
 	if nodeName == "" {
 		log.Fatal("NODE_NAME environment variable not set")
 	}
+	flag.Parse()
 
 	// 1. Connect to Kubernetes API
 	config, err := rest.InClusterConfig()
@@ -52,101 +255,277 @@ func main() {
 	}
 	defer m.Close()
 
-	log.Printf("Starting K8s watcher for node %s", nodeName)
+	a := &agent{m: m, version: cgroup.DetectVersion(cgroupRoot)}
+	podCache := newPodNameCache()
+	resolver := cgroup.NewChainResolver(
+		cgroup.SystemdResolver{},
+		cgroup.GuaranteedSystemdResolver{},
+		cgroup.CgroupfsResolver{},
+	)
 
-	// 3. Watch pods on this node
-	watch, err := clientset.CoreV1().Pods("").Watch(context.TODO(), metav1.ListOptions{
-		FieldSelector: fmt.Sprintf("spec.nodeName=%s", nodeName),
-	})
+	// 3. Serve /metrics and /slo/dump so the map can be inspected without
+	// bpftool. Bound to loopback by default.
+	server := slosrv.New(*metricsAddr, a, podCache)
+	a.metrics = server
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Printf("metrics server stopped: %v", err)
+		}
+	}()
+
+	log.Printf("Starting scx-slo agent for node %s", nodeName)
+
+	// 4. Prefer the NRI plugin: the runtime hands us the real cgroup path on
+	// every lifecycle event, so there's no racing the Pod object against the
+	// cgroup actually existing and no guessing the path layout. If NRI isn't
+	// available (or the runtime disables it mid-run), fall back to watching
+	// pods through the K8s API.
+	ctx := context.Background()
+	plugin, err := nriplugin.New(a, *autoSLO)
 	if err != nil {
-		log.Fatalf("Failed to watch pods: %v", err)
+		log.Printf("NRI plugin unavailable, falling back to K8s watch: %v", err)
+		watchPods(ctx, clientset, nodeName, a, podCache, resolver)
+		return
 	}
 
-	for event := range watch.ResultChan() {
-		pod, ok := event.Object.(*corev1.Pod)
-		if !ok {
-			continue
-		}
+	err = plugin.Run(ctx)
+	log.Printf("NRI plugin stopped (%v), falling back to K8s watch", err)
+	watchPods(ctx, clientset, nodeName, a, podCache, resolver)
+}
 
-		budgetStr, hasBudget := pod.Annotations[AnnotationBudget]
-		importStr, hasImportance := pod.Annotations[AnnotationImportance]
+// podWatcher is the fallback codepath for clusters without NRI support: it
+// reconstructs the cgroup path from the Pod UID and QOS class, which is
+// racy (the Pod can arrive before the cgroup exists) and fragile across
+// container runtimes. It uses a SharedIndexInformer rather than a raw Watch
+// so that it gets Delete events (to clean up slo_map) and automatic
+// reconnect/resync behavior for free.
+type podWatcher struct {
+	clientset *kubernetes.Clientset
+	nodeName  string
+	a         *agent
+	cache     *podNameCache // cached at Add time; cgroup dir is gone by Delete
+	resolver  *cgroup.ChainResolver
+}
 
-		if !hasBudget && !hasImportance {
-			continue
-		}
+// watchPods builds and runs a podWatcher until ctx is canceled.
+func watchPods(ctx context.Context, clientset *kubernetes.Clientset, nodeName string, a *agent, cache *podNameCache, resolver *cgroup.ChainResolver) {
+	w := &podWatcher{
+		clientset: clientset,
+		nodeName:  nodeName,
+		a:         a,
+		cache:     cache,
+		resolver:  resolver,
+	}
+	w.run(ctx)
+}
 
-		// Parse SLO values
-		budgetMs, _ := strconv.ParseUint(budgetStr, 10, 64)
-		importance, _ := strconv.ParseUint(importStr, 10, 32)
+func (w *podWatcher) run(ctx context.Context) {
+	listWatch := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", w.nodeName).String()
+			return w.clientset.CoreV1().Pods("").List(ctx, opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", w.nodeName).String()
+			return w.clientset.CoreV1().Pods("").Watch(ctx, opts)
+		},
+	}
 
-		if budgetMs == 0 {
-			budgetMs = 100 // Default 100ms
-		}
-		if importance == 0 {
-			importance = 50 // Default 50
-		}
+	informer := cache.NewSharedIndexInformer(listWatch, &corev1.Pod{}, 0, cache.Indexers{})
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				w.applySLO(pod)
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if pod, ok := newObj.(*corev1.Pod); ok {
+				w.applySLO(pod)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+					pod, ok = tombstone.Obj.(*corev1.Pod)
+					if !ok {
+						return
+					}
+				} else {
+					return
+				}
+			}
+			w.removeSLO(pod)
+		},
+	})
 
-		// Find Cgroup ID (Simplified: we use internal K8s logic or path resolution)
-		// This is a placeholder for the actual Cgroup resolution logic
-		// which usually involves reading /proc/<pid>/cgroup for one of the pod's containers
-		cgID, err := resolvePodCgroupID(pod)
-		if err != nil {
-			log.Printf("Could not resolve Cgroup ID for pod %s: %v", pod.Name, err)
-			continue
-		}
+	go w.reconcileLoop(ctx)
+
+	informer.Run(ctx.Done())
+}
+
+// applySLO resolves and programs the SLO for pod, caching the resolved cgID
+// so a later Delete event (when the cgroup dir no longer exists) can still
+// find it.
+func (w *podWatcher) applySLO(pod *corev1.Pod) {
+	budgetStr, hasBudget := pod.Annotations[AnnotationBudget]
+	importStr, hasImportance := pod.Annotations[AnnotationImportance]
 
-		// Update BPF Map
-		cfg := sloCfg{
-			BudgetNs:   budgetMs * 1000000,
-			Importance: uint32(importance),
-			Flags:      0,
+	if !hasBudget && !hasImportance {
+		if *autoSLO {
+			w.applyAutoSLO(pod)
 		}
+		return
+	}
+
+	budgetMs, _ := strconv.ParseUint(budgetStr, 10, 64)
+	importance, _ := strconv.ParseUint(importStr, 10, 32)
+	if budgetMs == 0 {
+		budgetMs = 100 // Default 100ms
+	}
+	if importance == 0 {
+		importance = 50 // Default 50
+	}
+
+	cgroupPath, err := w.resolver.Resolve(cgroupRoot, pod)
+	if err != nil {
+		w.a.recordResolveFailure()
+		log.Printf("Could not resolve Cgroup path for pod %s: %v", pod.Name, err)
+		return
+	}
+
+	cgID, err := cgroup.IDFromPath(cgroupPath, w.a.version)
+	if err != nil {
+		w.a.recordResolveFailure()
+		log.Printf("Could not resolve Cgroup ID for pod %s: %v", pod.Name, err)
+		return
+	}
+
+	w.cache.set(pod, cgID)
+
+	if err := w.a.UpdateSLO(cgroupPath, budgetMs, importance); err != nil {
+		log.Printf("Failed to update SLO for pod %s: %v", pod.Name, err)
+	}
+}
+
+// applyAutoSLO derives a budget and importance from the pod's cgroup CPU
+// limits and QOS class, for pods that carry neither scx-slo annotation.
+// Only reachable when --auto-slo is set.
+func (w *podWatcher) applyAutoSLO(pod *corev1.Pod) {
+	cgroupPath, err := w.resolver.Resolve(cgroupRoot, pod)
+	if err != nil {
+		w.a.recordResolveFailure()
+		log.Printf("auto-slo: could not resolve cgroup path for pod %s: %v", pod.Name, err)
+		return
+	}
 
-		if err := m.Update(cgID, cfg, ebpf.UpdateAny); err != nil {
-			log.Printf("Failed to update BPF map for pod %s (cgID %d): %v", pod.Name, cgID, err)
-		} else {
-			log.Printf("Updated SLO for pod %s: budget=%dms, importance=%d", pod.Name, budgetMs, importance)
+	importance := deriveImportanceFromQOS(pod.Status.QOSClass)
+	budgetMs, err := deriveBudgetFromCgroup(cgroupPath, importance)
+	if err != nil {
+		log.Printf("auto-slo: could not derive budget for pod %s: %v", pod.Name, err)
+		return
+	}
+
+	cgID, err := cgroup.IDFromPath(cgroupPath, w.a.version)
+	if err != nil {
+		w.a.recordResolveFailure()
+		log.Printf("auto-slo: could not resolve cgroup ID for pod %s: %v", pod.Name, err)
+		return
+	}
+
+	w.cache.set(pod, cgID)
+
+	if err := w.a.UpdateSLO(cgroupPath, budgetMs, importance); err != nil {
+		log.Printf("auto-slo: failed to update SLO for pod %s: %v", pod.Name, err)
+	}
+}
+
+// removeSLO deletes the slo_map entry for a pod that has been deleted. It
+// relies on the cgID cached at Add time, since the cgroup directory no
+// longer exists by the time the Delete event arrives.
+func (w *podWatcher) removeSLO(pod *corev1.Pod) {
+	cgID, ok := w.cache.delete(pod.UID)
+	if !ok {
+		return
+	}
+	if err := w.a.deleteCgID(cgID); err != nil {
+		log.Printf("Failed to delete SLO for pod %s: %v", pod.Name, err)
+	}
+}
+
+// reconcileLoop periodically prunes slo_map entries that don't correspond
+// to any pod currently scheduled on this node. This is what makes the
+// agent self-healing after a restart or a gap in informer events, since
+// kernel cgroup IDs get reused and a stale entry would otherwise silently
+// apply a dead pod's SLO to an unrelated cgroup.
+func (w *podWatcher) reconcileLoop(ctx context.Context) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.reconcileOnce(ctx)
 		}
 	}
 }
 
-// resolvePodCgroupID finds the 64-bit kernel cgroup ID for a given pod.
-// It constructs the cgroup path based on Pod UID and QOS class, then
-// uses name_to_handle_at to get the inode-based ID.
-func resolvePodCgroupID(pod *corev1.Pod) (uint64, error) {
-	uid := strings.ReplaceAll(string(pod.UID), "-", "_")
-	qos := strings.ToLower(string(pod.Status.QOSClass))
-	
-	// Construct the path (Standard for cgroupv2/systemd)
-	// Example: /sys/fs/cgroup/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<UID>.slice
-	basePath := "/sys/fs/cgroup/kubepods.slice"
-	qosPath := fmt.Sprintf("kubepods-%s.slice", qos)
-	podPath := fmt.Sprintf("kubepods-%s-pod%s.slice", qos, uid)
-	
-	fullPath := filepath.Join(basePath, qosPath, podPath)
-	
-	// Check if path exists
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		// Fallback for older K8s/different runtimes
-		fullPath = filepath.Join(basePath, podPath)
-	}
-
-	// Use name_to_handle_at to get the file handle (contains cgroup ID)
-	var mountID int32
-	handle := make([]byte, 128)
-	fh := (*unix.FileHandle)(unsafe.Pointer(&handle[0]))
-	fh.Size = 128 - 8 // Reserve space for the header
-
-	err := unix.NameToHandleAt(unix.AT_FDCWD, fullPath, fh, &mountID, 0)
+func (w *podWatcher) reconcileOnce(ctx context.Context) {
+	pods, err := w.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", w.nodeName).String(),
+	})
 	if err != nil {
-		return 0, fmt.Errorf("failed to get handle for %s: %v", fullPath, err)
+		log.Printf("reconcile: failed to list pods: %v", err)
+		return
 	}
 
-	// The first 8 bytes of the handle's data for cgroupv2 is the 64-bit ID
-	if fh.Size < 8 {
-		return 0, fmt.Errorf("handle too small for ID: %d", fh.Size)
+	expected := make(map[uint64]struct{}, len(pods.Items))
+	for _, pod := range pods.Items {
+		if cgID, ok := w.cache.cgIDForUID(pod.UID); ok {
+			expected[cgID] = struct{}{}
+		}
+	}
+
+	live, err := w.a.liveCgIDs()
+	if err != nil {
+		log.Printf("reconcile: failed to list slo_map entries: %v", err)
+		return
 	}
-	
-	cgID := *(*uint64)(unsafe.Pointer(&handle[8]))
-	return cgID, nil
+
+	for cgID := range live {
+		if _, ok := expected[cgID]; ok {
+			continue
+		}
+		if err := w.a.deleteCgID(cgID); err != nil {
+			log.Printf("reconcile: failed to delete stale cgID %d: %v", cgID, err)
+			continue
+		}
+		// This is exactly the case where the pod's own Delete event was
+		// missed, so removeSLO never ran to evict it from w.cache either;
+		// without this it would stay cached forever.
+		w.cache.deleteByCgID(cgID)
+	}
+}
+
+// deriveImportanceFromQOS maps a pod's Kubernetes QOS class onto the
+// scx-slo/importance scale (0-100), used when the annotation is absent.
+func deriveImportanceFromQOS(qos corev1.PodQOSClass) uint64 {
+	switch qos {
+	case corev1.PodQOSGuaranteed:
+		return 90
+	case corev1.PodQOSBurstable:
+		return 50
+	default: // BestEffort
+		return 10
+	}
+}
+
+// deriveBudgetFromCgroup computes a budget in milliseconds from the CPU
+// quota programmed on the pod's cgroup, scaled by importance. Unthrottled
+// cgroups (no quota, or cpu.max == "max") start from the default 100ms,
+// which is then scaled by importance like any other quota.
+func deriveBudgetFromCgroup(cgroupPath string, importance uint64) (uint64, error) {
+	return cgroup.DeriveBudgetMs(cgroupPath, importance)
 }